@@ -21,11 +21,16 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -34,13 +39,141 @@ import (
 // log is for logging in this package.
 var podlog = logf.Log.WithName("pod-resource")
 
+// labelGuard holds the configuration and evaluation pipeline shared by every
+// admission webhook in this package: load the effective PodLabelGuardPolicy
+// for a namespace, evaluate a label change against every guarded selector
+// (NetworkPolicy, plus every registered SelectorSource), and enforce the
+// resolved mode. PodValidator embeds it to guard pods directly; it also
+// backs WorkloadValidator, which projects the same label change from a
+// workload's pod template.
+type labelGuard struct {
+	Client   client.Client
+	Recorder record.EventRecorder
+	Sources  []SelectorSource
+	// Index, when non-nil and synced, lets evaluate narrow the
+	// NetworkPolicy/SelectorSource match-flip check down to the selectors
+	// that reference a changed label key, instead of listing every
+	// guarded resource kind (Service, Deployment, ...) on every request.
+	// It is nil-safe: until an index is wired in (or while it is still
+	// performing its initial sync), evaluate falls back to the
+	// List-based path for that check. evaluate still issues a handful of
+	// small, unindexed List calls regardless of Index (namespace labels,
+	// PodLabelGuardPolicy objects, and in-namespace NetworkPolicies for
+	// the named-port check) -- those are not selector matches Index
+	// tracks, so admission latency is O(#changed-labels) only for the
+	// part Index actually covers, not for the request as a whole.
+	Index *SelectorIndex
+}
+
+func newLabelGuard(c client.Client, r record.EventRecorder, idx *SelectorIndex) labelGuard {
+	return labelGuard{Client: c, Recorder: r, Sources: defaultSelectorSources(), Index: idx}
+}
+
+// evaluate runs the guard pipeline for a label change from oldLabels to
+// newLabels on an object living in namespace, and returns the admission
+// response to send. portNames are the named container ports the resulting
+// pods expose (nil if the caller has none to offer); they are checked
+// against any NetworkPolicy whose podSelector matches newLabels so a named
+// port a policy still references, but the pod no longer exposes, is
+// reported even though it does not participate in the match-flip warnings
+// above. Named-port findings are always warn-only and never affect the
+// Deny decision, since they can be orthogonal to (and pre-exist) the
+// label change under evaluation. subject is the object an Event is
+// recorded against in Dryrun mode; description is a short human-readable
+// identifier (e.g. "pod default/frontend-abc123") used in log lines.
+func (g *labelGuard) evaluate(ctx context.Context, namespace string, oldLabels, newLabels map[string]string, portNames map[string]struct{}, subject runtime.Object, description string) admission.Response {
+	if reflect.DeepEqual(oldLabels, newLabels) {
+		fmt.Println("No label changes detected for", description)
+		return admission.Allowed("No label changes detected")
+	}
+
+	nsLabels, err := namespaceLabelIndex(ctx, g.Client)
+	if err != nil {
+		fmt.Println("Error listing namespaces:", err)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	effective, err := loadEffectivePolicy(ctx, g.Client, namespace, nsLabels)
+	if err != nil {
+		fmt.Println("Error loading PodLabelGuardPolicy:", err)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	oldSet, newSet := labels.Set(oldLabels), labels.Set(newLabels)
+
+	var warnings []string
+	if g.Index != nil && g.Index.HasSynced() {
+		cacheHitsTotal.Inc()
+		warnings = indexedWarnings(g.Index, namespace, oldSet, newSet, nsLabels, effective.disabledSources)
+	} else {
+		// NetworkPolicy peers can reference pods in other namespaces via
+		// namespaceSelector, so policies must be considered cluster-wide
+		// rather than scoped to namespace. This List-based path also
+		// covers the cold-cache window before Index.HasSynced, since
+		// serving admission requests against a cold index would produce
+		// false negatives.
+		networkPolicyList := &networkingv1.NetworkPolicyList{}
+		if err := g.Client.List(ctx, networkPolicyList); err != nil {
+			fmt.Println("Error listing network policies:", err)
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		warnings = evaluatePolicyImpact(networkPolicyList.Items, namespace, oldSet, newSet, nsLabels)
+		warnings = append(warnings, selectorSourceWarnings(ctx, g.Client, g.Sources, effective.disabledSources, namespace, oldSet, newSet)...)
+	}
+
+	warnings = append(warnings, protectedLabelWarnings(effective.protectedLabels, oldLabels, newLabels)...)
+
+	// Named-port findings are collected separately from warnings and never
+	// factor into the Deny decision below: a policy referencing a port the
+	// pod/template doesn't expose is tolerated by design (the rule may just
+	// be ahead of a workload that hasn't rolled out yet), so it must not
+	// turn an otherwise-harmless label change into a rejected one. Always
+	// run, even when portNames is empty, since that's precisely the case
+	// (no named ports left at all) this is meant to catch. Scoped to
+	// namespace rather than served from Index, since a policy's ports are
+	// not something the index's match-flip entries carry.
+	var portWarnings []string
+	namespacePolicies := &networkingv1.NetworkPolicyList{}
+	if err := g.Client.List(ctx, namespacePolicies, client.InNamespace(namespace)); err != nil {
+		podlog.Error(err, "error listing network policies for named port analysis", "namespace", namespace)
+	} else {
+		portWarnings = namedPortWarnings(namespacePolicies.Items, namespace, newSet, portNames)
+	}
+
+	allWarnings := append(append([]string{}, warnings...), portWarnings...)
+	if len(allWarnings) == 0 {
+		fmt.Printf("%s labels are not referenced by any guarded selector\n", description)
+		return admission.Allowed("Labels are not referenced by any guarded selector")
+	}
+
+	fmt.Printf("Label change for %s affects %d guarded selector(s), enforcement mode %s\n", description, len(allWarnings), effective.mode)
+
+	switch effective.mode {
+	case EnforcementModeDeny:
+		if len(warnings) == 0 {
+			// Only named-port findings: always warn-only, never denied.
+			return admission.Allowed("").WithWarnings(portWarnings...)
+		}
+		return admission.Denied(fmt.Sprintf("label change rejected by PodLabelGuardPolicy: %v", warnings)).WithWarnings(portWarnings...)
+	case EnforcementModeDryrun:
+		if g.Recorder != nil {
+			for _, w := range allWarnings {
+				g.Recorder.Event(subject, corev1.EventTypeWarning, "PodLabelGuardDryRun", w)
+			}
+		}
+		return admission.Allowed("").WithWarnings(allWarnings...)
+	default:
+		return admission.Allowed("").WithWarnings(allWarnings...)
+	}
+}
+
 type PodValidator struct {
-	Client  client.Client
+	labelGuard
 	decoder admission.Decoder
 }
 
-func NewPodValidator(c client.Client, d admission.Decoder) *PodValidator {
-	return &PodValidator{Client: c, decoder: d}
+func NewPodValidator(c client.Client, d admission.Decoder, r record.EventRecorder, idx *SelectorIndex) *PodValidator {
+	return &PodValidator{labelGuard: newLabelGuard(c, r, idx), decoder: d}
 }
 
 // PodValidator admits a pod if a specific annotation exists.
@@ -58,8 +191,12 @@ func (v *PodValidator) Handle(ctx context.Context, req admission.Request) admiss
 
 		if changed -
 
-		check if any network policy contains these pod labels
+		check if any network policy peer (podSelector/namespaceSelector) or
+		podSelector target is affected by the change, in either direction
 	*/
+	start := time.Now()
+	defer func() { admissionLatencySeconds.Observe(time.Since(start).Seconds()) }()
+
 	pod := &corev1.Pod{}
 
 	err := v.decoder.Decode(req, pod)
@@ -80,38 +217,316 @@ func (v *PodValidator) Handle(ctx context.Context, req admission.Request) admiss
 		return admission.Allowed("New pod creation")
 	}
 
-	// Check if labels have changed
-	if reflect.DeepEqual(originalPod.Labels, pod.Labels) {
-		fmt.Println("No label changes detected for pod:", pod.GetName())
-		return admission.Allowed("No label changes detected")
+	return v.evaluate(ctx, pod.Namespace, originalPod.Labels, pod.Labels, containerPortNames(pod.Spec.Containers), pod, fmt.Sprintf("pod %s", pod.GetName()))
+}
+
+// effectivePolicy is the resolved configuration applied to a single
+// admission request, after merging every PodLabelGuardPolicy whose
+// namespaceSelector matches the pod's namespace.
+type effectivePolicy struct {
+	mode            EnforcementMode
+	protectedLabels []string
+	disabledSources map[string]struct{}
+}
+
+// loadEffectivePolicy fetches PodLabelGuardPolicy objects, keeps the ones
+// scoped to podNamespace, and merges them: protectedLabels are unioned and
+// the strictest mode wins (Deny > Dryrun > Warn), so that a namespace
+// covered by more than one policy never ends up less guarded than either
+// policy intended on its own.
+func loadEffectivePolicy(ctx context.Context, c client.Client, podNamespace string, nsLabels map[string]labels.Set) (effectivePolicy, error) {
+	result := effectivePolicy{mode: EnforcementModeWarn}
+
+	policyList := &PodLabelGuardPolicyList{}
+	if err := c.List(ctx, policyList); err != nil {
+		return result, err
 	}
 
-	// Fetch NetworkPolicies in the namespace
-	networkPolicyList := &networkingv1.NetworkPolicyList{}
-	filters := []client.ListOption{
-		client.InNamespace(pod.GetNamespace()),
+	set, ok := nsLabels[podNamespace]
+	if !ok {
+		set = labels.Set{}
 	}
-	if err := v.Client.List(ctx, networkPolicyList, filters...); err != nil {
-		fmt.Println("Error listing network policies:", err)
-		return admission.Errored(http.StatusInternalServerError, err)
+
+	protected := map[string]struct{}{}
+	var matched bool
+	disabled := map[string]struct{}{}
+	for i := range policyList.Items {
+		policy := &policyList.Items[i]
+		matches, err := selectorMatches(policy.Spec.NamespaceSelector, set)
+		if err != nil {
+			podlog.Error(err, "invalid namespaceSelector on PodLabelGuardPolicy", "policy", policy.Name)
+			continue
+		}
+		if !matches {
+			continue
+		}
+		matched = true
+		for _, key := range policy.Spec.ProtectedLabels {
+			protected[key] = struct{}{}
+		}
+		for _, name := range policy.Spec.DisabledSources {
+			disabled[name] = struct{}{}
+		}
+		if enforcementRank(policy.Spec.Mode) > enforcementRank(result.mode) {
+			result.mode = policy.Spec.Mode
+		}
 	}
 
-	// Check if any NetworkPolicy references the original pod's labels
-	for _, networkPolicy := range networkPolicyList.Items {
-		if matchesLabels(originalPod.Labels, networkPolicy.Spec.PodSelector.MatchLabels) {
-			fmt.Printf("Labels for pod %s are referenced in a NetworkPolicy\n", pod.GetName())
-			// Log a warning but allow the change
-			return admission.Allowed("").WithWarnings("Pod labels are referenced in a NetworkPolicy")
+	for key := range protected {
+		result.protectedLabels = append(result.protectedLabels, key)
+	}
+	// Only apply disabledSources when at least one policy actually matched
+	// the namespace; otherwise every namespace with no PodLabelGuardPolicy
+	// at all would silently disable nothing, which is already the default.
+	if matched {
+		result.disabledSources = disabled
+	}
+	return result, nil
+}
+
+// enforcementRank orders enforcement modes from least to most strict so the
+// strictest mode across matching policies can be selected deterministically.
+func enforcementRank(mode EnforcementMode) int {
+	switch mode {
+	case EnforcementModeDeny:
+		return 2
+	case EnforcementModeDryrun:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// protectedLabelWarnings always guards protectedLabels keys, independent of
+// whether any NetworkPolicy currently references them.
+func protectedLabelWarnings(protectedLabels []string, oldLabels, newLabels map[string]string) []string {
+	var warnings []string
+	for _, key := range protectedLabels {
+		oldVal, hadOld := oldLabels[key]
+		newVal, hasNew := newLabels[key]
+		if hadOld && !hasNew {
+			warnings = append(warnings, fmt.Sprintf("protected label %q was removed", key))
+		} else if hadOld && hasNew && oldVal != newVal {
+			warnings = append(warnings, fmt.Sprintf("protected label %q changed from %q to %q", key, oldVal, newVal))
 		}
 	}
+	return warnings
+}
 
-	fmt.Printf("Pod %s labels are not referenced in any NetworkPolicy\n", pod.GetName())
-	return admission.Allowed("Labels are not referenced in any NetworkPolicy")
+// indexedWarnings serves the same warnings evaluatePolicyImpact and
+// selectorSourceWarnings would, but from idx: it takes only the label keys
+// that changed and asks the index for the (already filtered by reference)
+// entries that could possibly flip as a result, instead of listing every
+// guarded resource kind.
+func indexedWarnings(idx *SelectorIndex, namespace string, oldLabels, newLabels labels.Set, nsLabels map[string]labels.Set, disabledSources map[string]struct{}) []string {
+	changedKeys := symmetricDiffKeys(oldLabels, newLabels)
+
+	var warnings []string
+	for _, entry := range idx.Lookup(changedKeys) {
+		if entry.sourceName != "" {
+			if _, skip := disabledSources[entry.sourceName]; skip {
+				continue
+			}
+		}
+		if warning, changed := entry.describe(oldLabels, newLabels, namespace, nsLabels); changed {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// namespaceLabelIndex builds a namespace name -> labels.Set lookup so that
+// namespaceSelector peers can be evaluated without a List call per peer.
+func namespaceLabelIndex(ctx context.Context, c client.Client) (map[string]labels.Set, error) {
+	namespaceList := &corev1.NamespaceList{}
+	if err := c.List(ctx, namespaceList); err != nil {
+		return nil, err
+	}
+	index := make(map[string]labels.Set, len(namespaceList.Items))
+	for _, ns := range namespaceList.Items {
+		index[ns.Name] = labels.Set(ns.Labels)
+	}
+	return index, nil
+}
+
+// evaluatePolicyImpact walks every NetworkPolicy's podSelector (target) and
+// ingress/egress peers and reports, for each one whose match status flips
+// between oldLabels and newLabels for a subject living in namespace, a
+// human-readable warning. It catches both directions of breakage: a subject
+// that stops matching (traffic that was allowed may now be blocked) and one
+// that newly matches (new isolation or new peer access may unexpectedly
+// take effect).
+func evaluatePolicyImpact(policies []networkingv1.NetworkPolicy, namespace string, oldLabels, newLabels labels.Set, nsLabels map[string]labels.Set) []string {
+	var warnings []string
+
+	for i := range policies {
+		policy := &policies[i]
+
+		// The policy's own podSelector only ever targets pods in its own
+		// namespace.
+		if policy.Namespace == namespace {
+			oldTarget, err := selectorMatches(&policy.Spec.PodSelector, oldLabels)
+			if err != nil {
+				podlog.Error(err, "invalid podSelector on NetworkPolicy", "networkPolicy", policy.Name, "namespace", policy.Namespace)
+			} else {
+				newTarget, err := selectorMatches(&policy.Spec.PodSelector, newLabels)
+				if err != nil {
+					podlog.Error(err, "invalid podSelector on NetworkPolicy", "networkPolicy", policy.Name, "namespace", policy.Namespace)
+				} else if oldTarget && !newTarget {
+					warnings = append(warnings, fmt.Sprintf(
+						"NetworkPolicy %s/%s: pod no longer matches podSelector; isolation rules defined by this policy no longer apply",
+						policy.Namespace, policy.Name))
+				} else if !oldTarget && newTarget {
+					warnings = append(warnings, fmt.Sprintf(
+						"NetworkPolicy %s/%s: pod newly matches podSelector; new ingress/egress isolation now applies and may cut off previously allowed traffic",
+						policy.Namespace, policy.Name))
+				}
+			}
+		}
+
+		for ruleIdx, rule := range policy.Spec.Ingress {
+			for peerIdx, peer := range rule.From {
+				warnings = append(warnings, evaluatePeerImpact(policy, "ingress", ruleIdx, peerIdx, peer, namespace, oldLabels, newLabels, nsLabels)...)
+			}
+		}
+
+		for ruleIdx, rule := range policy.Spec.Egress {
+			for peerIdx, peer := range rule.To {
+				warnings = append(warnings, evaluatePeerImpact(policy, "egress", ruleIdx, peerIdx, peer, namespace, oldLabels, newLabels, nsLabels)...)
+			}
+		}
+	}
+
+	return warnings
+}
+
+// evaluatePeerImpact reports a warning when the pod's match status against a
+// single ingress/egress peer flips as a result of the label change.
+func evaluatePeerImpact(policy *networkingv1.NetworkPolicy, ruleType string, ruleIdx, peerIdx int, peer networkingv1.NetworkPolicyPeer, podNamespace string, oldLabels, newLabels labels.Set, nsLabels map[string]labels.Set) []string {
+	// ipBlock peers are never label-based and cannot be affected by a label
+	// change.
+	if peer.IPBlock != nil {
+		return nil
+	}
+
+	oldMatch, err := peerMatches(peer, policy.Namespace, podNamespace, oldLabels, nsLabels)
+	if err != nil {
+		podlog.Error(err, "invalid peer selector on NetworkPolicy", "networkPolicy", policy.Name, "namespace", policy.Namespace)
+		return nil
+	}
+	newMatch, err := peerMatches(peer, policy.Namespace, podNamespace, newLabels, nsLabels)
+	if err != nil {
+		podlog.Error(err, "invalid peer selector on NetworkPolicy", "networkPolicy", policy.Name, "namespace", policy.Namespace)
+		return nil
+	}
+
+	if oldMatch == newMatch {
+		return nil
+	}
+
+	if oldMatch && !newMatch {
+		return []string{fmt.Sprintf(
+			"NetworkPolicy %s/%s %s rule %d peer %d: pod no longer matches peer selector; traffic allowed by this rule may break",
+			policy.Namespace, policy.Name, ruleType, ruleIdx, peerIdx)}
+	}
+	return []string{fmt.Sprintf(
+		"NetworkPolicy %s/%s %s rule %d peer %d: pod newly matches peer selector; traffic described by this rule now newly applies",
+		policy.Namespace, policy.Name, ruleType, ruleIdx, peerIdx)}
+}
+
+// containerPortNames collects every named container port across containers,
+// which callers use to check whether a pod (or projected workload template)
+// still exposes a port a NetworkPolicy references by name. Unnamed ports
+// are omitted since NetworkPolicy can only reference a port by name or by
+// number, and a numbered reference cannot be broken by a label change.
+func containerPortNames(containers []corev1.Container) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.Name != "" {
+				names[p.Name] = struct{}{}
+			}
+		}
+	}
+	return names
+}
+
+// namedPortWarnings reports every NetworkPolicy in namespace whose
+// podSelector matches podLabels but references, via a named port in an
+// ingress rule, a container port not present in portNames. It only ever
+// warns, mirroring NetworkPolicy's own admission-time behavior of not
+// blocking on a named port that does not currently resolve to any pod --
+// the rule may simply be ahead of a workload that has not rolled out yet.
+func namedPortWarnings(policies []networkingv1.NetworkPolicy, namespace string, podLabels labels.Set, portNames map[string]struct{}) []string {
+	var warnings []string
+	for i := range policies {
+		policy := &policies[i]
+		if policy.Namespace != namespace {
+			continue
+		}
+		matches, err := selectorMatches(&policy.Spec.PodSelector, podLabels)
+		if err != nil || !matches {
+			continue
+		}
+		for ruleIdx, rule := range policy.Spec.Ingress {
+			for _, port := range rule.Ports {
+				if port.Port == nil || port.Port.Type != intstr.String {
+					continue
+				}
+				name := port.Port.StrVal
+				if _, ok := portNames[name]; !ok {
+					warnings = append(warnings, fmt.Sprintf(
+						"NetworkPolicy %s/%s ingress rule %d references named port %q, which this pod does not expose",
+						policy.Namespace, policy.Name, ruleIdx, name))
+				}
+			}
+		}
+	}
+	return warnings
 }
 
-func matchesLabels(podslabels map[string]string, netPolLabels map[string]string) bool {
-	selector := labels.Set(netPolLabels).AsSelectorPreValidated()
-	return selector.Matches(labels.Set(podslabels))
+// peerMatches evaluates whether a pod, identified by podNamespace and
+// podLabels, is selected by a NetworkPolicyPeer defined on a policy that
+// lives in policyNamespace. It mirrors the semantics documented for
+// NetworkPolicyPeer: a nil namespaceSelector restricts the peer to the
+// policy's own namespace, while a non-nil (possibly empty) namespaceSelector
+// is matched against namespace labels, as kube-router does.
+func peerMatches(peer networkingv1.NetworkPolicyPeer, policyNamespace, podNamespace string, podLabels labels.Set, nsLabels map[string]labels.Set) (bool, error) {
+	nsMatch := false
+	if peer.NamespaceSelector != nil {
+		set, ok := nsLabels[podNamespace]
+		if !ok {
+			set = labels.Set{}
+		}
+		m, err := selectorMatches(peer.NamespaceSelector, set)
+		if err != nil {
+			return false, err
+		}
+		nsMatch = m
+	} else {
+		nsMatch = podNamespace == policyNamespace
+	}
+
+	if !nsMatch {
+		return false, nil
+	}
+
+	return selectorMatches(peer.PodSelector, podLabels)
+}
+
+// selectorMatches evaluates a LabelSelector (which may use matchExpressions
+// as well as matchLabels) against a set of labels. A nil selector is treated
+// as "select everything", matching the NetworkPolicyPeer convention where an
+// absent podSelector/namespaceSelector means "all".
+func selectorMatches(sel *metav1.LabelSelector, set labels.Set) (bool, error) {
+	if sel == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(set), nil
 }
 
 // PodValidator implements admission.DecoderInjector.
@@ -0,0 +1,113 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EnforcementMode controls how PodValidator reacts once it has determined
+// that a label change breaks (or newly triggers) a selector match.
+// +kubebuilder:validation:Enum=Warn;Deny;Dryrun
+type EnforcementMode string
+
+const (
+	// EnforcementModeWarn allows the request but attaches a warning to the
+	// admission response. This is the default.
+	EnforcementModeWarn EnforcementMode = "Warn"
+
+	// EnforcementModeDeny rejects the request outright with a structured
+	// reason describing every affected selector.
+	EnforcementModeDeny EnforcementMode = "Deny"
+
+	// EnforcementModeDryrun allows the request and records a Kubernetes
+	// Event on the admitted object (the Pod, or the workload whose pod
+	// template changed) in addition to a warning, so operators can observe
+	// impact before switching to Deny.
+	EnforcementModeDryrun EnforcementMode = "Dryrun"
+)
+
+// PodLabelGuardPolicySpec defines the desired enforcement behavior of
+// PodValidator for the namespaces it selects.
+type PodLabelGuardPolicySpec struct {
+	// NamespaceSelector scopes this policy to namespaces whose labels match.
+	// An empty or nil selector matches every namespace.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Mode selects the enforcement behavior applied when a label change
+	// affects a NetworkPolicy (or other guarded selector) match.
+	// +kubebuilder:default=Warn
+	// +optional
+	Mode EnforcementMode `json:"mode,omitempty"`
+
+	// ProtectedLabels are label keys that are always guarded on removal or
+	// value change, regardless of whether a NetworkPolicy currently
+	// references them. Useful for keys like "app" or "tier" that are known
+	// to be load-bearing even before a NetworkPolicy is written against
+	// them.
+	// +optional
+	ProtectedLabels []string `json:"protectedLabels,omitempty"`
+
+	// DisabledSources opts a namespace out of guarding specific
+	// selector-bearing resource kinds (e.g. "Service",
+	// "PodDisruptionBudget", "Deployment", "ReplicaSet", "StatefulSet",
+	// "DaemonSet", "Job", "HorizontalPodAutoscaler"). NetworkPolicy
+	// guarding cannot be disabled this way. Every other kind is guarded by
+	// default.
+	// +optional
+	DisabledSources []string `json:"disabledSources,omitempty"`
+}
+
+// PodLabelGuardPolicyStatus is the observed state of a PodLabelGuardPolicy.
+type PodLabelGuardPolicyStatus struct {
+	// ObservedGeneration is the most recent generation of this policy
+	// observed by a controller. No code in this package writes it:
+	// PodValidator and WorkloadValidator list PodLabelGuardPolicy objects
+	// on every request rather than reconciling a policy cache.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.spec.mode`
+
+// PodLabelGuardPolicy lets operators declare, per-namespace or
+// label-selector-scoped, how PodValidator should enforce label-change
+// guarding: warn only, deny the request, or dry-run via a recorded Event.
+type PodLabelGuardPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PodLabelGuardPolicySpec   `json:"spec,omitempty"`
+	Status PodLabelGuardPolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PodLabelGuardPolicyList contains a list of PodLabelGuardPolicy.
+type PodLabelGuardPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PodLabelGuardPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PodLabelGuardPolicy{}, &PodLabelGuardPolicyList{})
+}
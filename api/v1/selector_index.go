@@ -0,0 +1,539 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var (
+	admissionLatencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "podlabelguard_admission_latency_seconds",
+		Help:    "Latency of PodValidator.Handle and WorkloadValidator.Handle from request receipt to admission response.",
+		Buckets: prometheus.DefBuckets,
+	})
+	indexSizeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "podlabelguard_index_size",
+		Help: "Number of selector entries currently held in the in-memory SelectorIndex.",
+	})
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "podlabelguard_cache_hits_total",
+		Help: "Admission requests whose selector match-flip check was served from SelectorIndex rather than a live List.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(admissionLatencySeconds, indexSizeGauge, cacheHitsTotal)
+}
+
+// indexEntry is one label-selector-bearing fact the index has learned about
+// a single source object (a NetworkPolicy's podSelector, one of its peers,
+// or a SelectorSource ref). describe re-evaluates the entry against the
+// current admission request and returns a warning plus whether the match
+// status flipped; it closes over whatever the entry needs (the policy, the
+// peer, the SelectorRef) so the index itself only has to store opaque
+// entries keyed by label key.
+type indexEntry struct {
+	// sourceName identifies the SelectorSource this entry came from (e.g.
+	// "Service"), so Lookup callers can honor a PodLabelGuardPolicy's
+	// disabledSources. Empty for NetworkPolicy entries, which
+	// disabledSources cannot opt out of.
+	sourceName string
+	describe   func(oldLabels, newLabels labels.Set, podNamespace string, nsLabels map[string]labels.Set) (warning string, changed bool)
+}
+
+// SelectorIndex maintains a reverse index, keyed by label key, of every
+// NetworkPolicy and SelectorSource selector PodValidator/WorkloadValidator
+// guard against. It is populated by a set of controller-runtime
+// controllers (registered via SetupWithManager) that watch NetworkPolicy
+// and the SelectorSource kinds, so the selector match-flip check no
+// longer has to List every guarded resource kind cluster-wide on the hot
+// path: it computes the symmetric difference between a pod's old and new
+// labels and looks up only the entries that reference one of the changed
+// keys. labelGuard.evaluate still makes a few small List calls of its own
+// outside the scope of this index (namespace labels, PodLabelGuardPolicy
+// objects, in-namespace NetworkPolicies for the named-port check).
+type SelectorIndex struct {
+	mu sync.RWMutex
+	// byObject holds every entry produced by one source object, so a
+	// reconcile can cheaply discard the previous entries before installing
+	// the new ones.
+	byObject map[string][]indexEntry
+	// byKey maps a label key to the set of object keys that have at least
+	// one entry referencing it.
+	byKey map[string]map[string]struct{}
+
+	syncedMu sync.Mutex
+	synced   bool
+}
+
+// NewSelectorIndex returns an empty SelectorIndex. Call SetupWithManager to
+// start the controllers that keep it populated.
+func NewSelectorIndex() *SelectorIndex {
+	return &SelectorIndex{
+		byObject: map[string][]indexEntry{},
+		byKey:    map[string]map[string]struct{}{},
+	}
+}
+
+// HasSynced reports whether every controller registered by SetupWithManager
+// has completed its initial cache sync. PodValidator.Handle must not trust
+// the index before this returns true, since a cold cache would silently
+// under-report affected selectors.
+func (idx *SelectorIndex) HasSynced() bool {
+	idx.syncedMu.Lock()
+	defer idx.syncedMu.Unlock()
+	return idx.synced
+}
+
+func (idx *SelectorIndex) markSynced() {
+	idx.syncedMu.Lock()
+	defer idx.syncedMu.Unlock()
+	idx.synced = true
+}
+
+// update replaces every entry previously recorded for objectKey with
+// entries, fanning byKey out to every key in keys. entries is stored as a
+// single slice under objectKey regardless of how many keys it is indexed
+// under, and Lookup returns that whole slice whenever any one of keys
+// matches a changed label -- it does not (and does not need to) track
+// which specific entry belongs to which key, since every entry's describe
+// re-checks the match itself and reports changed=false when it wasn't
+// actually affected. Passing nil entries (or calling remove) is how a
+// reconcile reports that the source object was deleted.
+func (idx *SelectorIndex) update(objectKey string, entries []indexEntry, keys map[string]struct{}) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(objectKey)
+
+	for key := range keys {
+		if idx.byKey[key] == nil {
+			idx.byKey[key] = map[string]struct{}{}
+		}
+		idx.byKey[key][objectKey] = struct{}{}
+	}
+	if len(entries) > 0 {
+		idx.byObject[objectKey] = entries
+	}
+	indexSizeGauge.Set(float64(idx.sizeLocked()))
+}
+
+func (idx *SelectorIndex) remove(objectKey string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(objectKey)
+	indexSizeGauge.Set(float64(idx.sizeLocked()))
+}
+
+func (idx *SelectorIndex) removeLocked(objectKey string) {
+	delete(idx.byObject, objectKey)
+	for key, objects := range idx.byKey {
+		delete(objects, objectKey)
+		if len(objects) == 0 {
+			delete(idx.byKey, key)
+		}
+	}
+}
+
+func (idx *SelectorIndex) sizeLocked() int {
+	n := 0
+	for _, entries := range idx.byObject {
+		n += len(entries)
+	}
+	return n
+}
+
+// Lookup returns every entry of every source object that has at least one
+// entry referencing one of changedKeys, deduplicated by object (see update:
+// an object's whole entry slice is returned, not only the entries that
+// reference a changed key).
+func (idx *SelectorIndex) Lookup(changedKeys []string) []indexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	seen := map[string]struct{}{}
+	var out []indexEntry
+	for _, key := range changedKeys {
+		for objectKey := range idx.byKey[key] {
+			if _, ok := seen[objectKey]; ok {
+				continue
+			}
+			seen[objectKey] = struct{}{}
+			out = append(out, idx.byObject[objectKey]...)
+		}
+	}
+	return out
+}
+
+// symmetricDiffKeys returns every label key whose presence or value differs
+// between oldLabels and newLabels, so Lookup only has to consider selectors
+// that could possibly have flipped.
+func symmetricDiffKeys(oldLabels, newLabels map[string]string) []string {
+	var changed []string
+	for key, oldVal := range oldLabels {
+		if newVal, ok := newLabels[key]; !ok || newVal != oldVal {
+			changed = append(changed, key)
+		}
+	}
+	for key := range newLabels {
+		if _, ok := oldLabels[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// selectorKeys returns the label keys a selector's requirements reference,
+// so an entry can be indexed only under the keys that can actually affect
+// its match result.
+func selectorKeys(sel labels.Selector) []string {
+	if sel == nil {
+		return nil
+	}
+	reqs, selectable := sel.Requirements()
+	if !selectable {
+		return nil
+	}
+	keys := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		keys = append(keys, req.Key())
+	}
+	return keys
+}
+
+// objectKey identifies a source object across reconciles so stale entries
+// can be replaced rather than accumulated.
+func objectKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// SetupWithManager registers a controller per guarded resource kind
+// (NetworkPolicy plus every SelectorSource kind) that keeps idx up to date,
+// and a manager Runnable that flips HasSynced once every controller's
+// informer has completed its initial List+Watch sync.
+func (idx *SelectorIndex) SetupWithManager(mgr ctrl.Manager) error {
+	builders := []func(ctrl.Manager, *SelectorIndex) error{
+		indexNetworkPolicies,
+		indexServices,
+		indexPodDisruptionBudgets,
+		indexDeployments,
+		indexReplicaSets,
+		indexStatefulSets,
+		indexDaemonSets,
+		indexJobs,
+		indexHorizontalPodAutoscalers,
+	}
+	for _, build := range builders {
+		if err := build(mgr, idx); err != nil {
+			return err
+		}
+	}
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if !mgr.GetCache().WaitForCacheSync(ctx) {
+			return fmt.Errorf("selector index: cache sync was cancelled before completing")
+		}
+		idx.markSynced()
+		podlog.Info("selector index cache sync complete, admission lookups will be served from the index")
+		return nil
+	}))
+}
+
+func indexNetworkPolicies(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&networkingv1.NetworkPolicy{}).
+		Complete(reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			key := objectKey("NetworkPolicy", req.Namespace, req.Name)
+			policy := &networkingv1.NetworkPolicy{}
+			if err := mgr.GetClient().Get(ctx, req.NamespacedName, policy); err != nil {
+				if errors.IsNotFound(err) {
+					idx.remove(key)
+					return reconcile.Result{}, nil
+				}
+				return reconcile.Result{}, err
+			}
+			entries, keys := networkPolicyEntries(policy)
+			idx.update(key, entries, keys)
+			return reconcile.Result{}, nil
+		}))
+}
+
+// networkPolicyEntries builds the indexed target and peer entries for a
+// single NetworkPolicy, reusing the same warning wording as
+// evaluatePolicyImpact/evaluatePeerImpact so the indexed and unindexed
+// paths are indistinguishable to an operator reading the warnings. Each
+// entry is appended to entries exactly once; keys is the union of every
+// label key any of those entries' selectors reference, which is all
+// update needs to fan byKey out (see update's comment for why it doesn't
+// track entry-to-key more precisely than that).
+func networkPolicyEntries(policy *networkingv1.NetworkPolicy) ([]indexEntry, map[string]struct{}) {
+	var entries []indexEntry
+	keys := map[string]struct{}{}
+	add := func(sel *metav1.LabelSelector, entry indexEntry) {
+		entries = append(entries, entry)
+		for _, key := range selectorKeysFromLabelSelector(sel) {
+			keys[key] = struct{}{}
+		}
+	}
+
+	policyNamespace, policyName := policy.Namespace, policy.Name
+	podSelector := policy.Spec.PodSelector
+	add(&podSelector, indexEntry{
+		describe: func(oldLabels, newLabels labels.Set, podNamespace string, _ map[string]labels.Set) (string, bool) {
+			if podNamespace != policyNamespace {
+				return "", false
+			}
+			oldMatch, err := selectorMatches(&podSelector, oldLabels)
+			if err != nil {
+				return "", false
+			}
+			newMatch, err := selectorMatches(&podSelector, newLabels)
+			if err != nil || oldMatch == newMatch {
+				return "", false
+			}
+			if oldMatch && !newMatch {
+				return fmt.Sprintf(
+					"NetworkPolicy %s/%s: pod no longer matches podSelector; isolation rules defined by this policy no longer apply",
+					policyNamespace, policyName), true
+			}
+			return fmt.Sprintf(
+				"NetworkPolicy %s/%s: pod newly matches podSelector; new ingress/egress isolation now applies and may cut off previously allowed traffic",
+				policyNamespace, policyName), true
+		},
+	})
+
+	for ruleIdx, rule := range policy.Spec.Ingress {
+		for peerIdx, peer := range rule.From {
+			addPeerEntry(add, policy, "ingress", ruleIdx, peerIdx, peer)
+		}
+	}
+	for ruleIdx, rule := range policy.Spec.Egress {
+		for peerIdx, peer := range rule.To {
+			addPeerEntry(add, policy, "egress", ruleIdx, peerIdx, peer)
+		}
+	}
+	return entries, keys
+}
+
+func addPeerEntry(add func(*metav1.LabelSelector, indexEntry), policy *networkingv1.NetworkPolicy, ruleType string, ruleIdx, peerIdx int, peer networkingv1.NetworkPolicyPeer) {
+	// ipBlock peers are never label-based, and a peer with no podSelector
+	// cannot be affected by a label change at all (only by namespace
+	// labels, which this index does not key on).
+	if peer.IPBlock != nil || peer.PodSelector == nil {
+		return
+	}
+	policyNamespace, policyName := policy.Namespace, policy.Name
+	add(peer.PodSelector, indexEntry{
+		describe: func(oldLabels, newLabels labels.Set, podNamespace string, nsLabels map[string]labels.Set) (string, bool) {
+			oldMatch, err := peerMatches(peer, policyNamespace, podNamespace, oldLabels, nsLabels)
+			if err != nil {
+				return "", false
+			}
+			newMatch, err := peerMatches(peer, policyNamespace, podNamespace, newLabels, nsLabels)
+			if err != nil || oldMatch == newMatch {
+				return "", false
+			}
+			if oldMatch && !newMatch {
+				return fmt.Sprintf(
+					"NetworkPolicy %s/%s %s rule %d peer %d: pod no longer matches peer selector; traffic allowed by this rule may break",
+					policyNamespace, policyName, ruleType, ruleIdx, peerIdx), true
+			}
+			return fmt.Sprintf(
+				"NetworkPolicy %s/%s %s rule %d peer %d: pod newly matches peer selector; traffic described by this rule now newly applies",
+				policyNamespace, policyName, ruleType, ruleIdx, peerIdx), true
+		},
+	})
+}
+
+// selectorSourceEntry builds the indexed entry for a single SelectorRef,
+// reusing the exact warning wording selectorSourceWarnings already emits.
+// describe skips any pod outside ref.Namespace: Services, PDBs, and
+// workload selectors only ever select pods in their own namespace, which
+// is also why selectorSourceWarnings scopes its source.List calls with
+// client.InNamespace. Without this check a pod in an unrelated namespace
+// would spuriously match an identically-selectored object elsewhere.
+func selectorSourceEntry(ref SelectorRef) ([]indexEntry, map[string]struct{}) {
+	entry := indexEntry{
+		sourceName: ref.Kind,
+		describe: func(oldLabels, newLabels labels.Set, podNamespace string, _ map[string]labels.Set) (string, bool) {
+			if podNamespace != ref.Namespace {
+				return "", false
+			}
+			oldMatch := ref.Selector.Matches(oldLabels)
+			newMatch := ref.Selector.Matches(newLabels)
+			if oldMatch == newMatch {
+				return "", false
+			}
+			if oldMatch && !newMatch {
+				return fmt.Sprintf("%s %s/%s selector no longer matches", ref.Kind, ref.Namespace, ref.Name), true
+			}
+			return fmt.Sprintf("%s %s/%s selector newly matches", ref.Kind, ref.Namespace, ref.Name), true
+		},
+	}
+	entries := []indexEntry{entry}
+	keys := map[string]struct{}{}
+	for _, key := range selectorKeys(ref.Selector) {
+		keys[key] = struct{}{}
+	}
+	return entries, keys
+}
+
+// indexSingleSource registers a controller for T that re-derives the
+// object's SelectorRef (via toRef) on every reconcile and keeps idx's
+// entries for it up to date. Every SelectorSource kind shares this one
+// reconcile shape; only the object type and ref conversion differ.
+func indexSingleSource[T client.Object](mgr ctrl.Manager, idx *SelectorIndex, kind string, newObj func() T, toRef func(T) (*SelectorRef, error)) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(newObj()).
+		Complete(reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			key := objectKey(kind, req.Namespace, req.Name)
+			obj := newObj()
+			if err := mgr.GetClient().Get(ctx, req.NamespacedName, obj); err != nil {
+				if errors.IsNotFound(err) {
+					idx.remove(key)
+					return reconcile.Result{}, nil
+				}
+				return reconcile.Result{}, err
+			}
+			ref, err := toRef(obj)
+			if err != nil {
+				podlog.Error(err, "invalid selector, dropping from index", "kind", kind, "namespace", req.Namespace, "name", req.Name)
+				idx.remove(key)
+				return reconcile.Result{}, nil
+			}
+			if ref == nil {
+				idx.remove(key)
+				return reconcile.Result{}, nil
+			}
+			entries, keyed := selectorSourceEntry(*ref)
+			idx.update(key, entries, keyed)
+			return reconcile.Result{}, nil
+		}))
+}
+
+func indexServices(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "Service", func() *corev1.Service { return &corev1.Service{} }, func(svc *corev1.Service) (*SelectorRef, error) {
+		if len(svc.Spec.Selector) == 0 {
+			return nil, nil
+		}
+		return &SelectorRef{Kind: "Service", Namespace: svc.Namespace, Name: svc.Name, Selector: labels.SelectorFromSet(svc.Spec.Selector)}, nil
+	})
+}
+
+func indexPodDisruptionBudgets(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "PodDisruptionBudget", func() *policyv1.PodDisruptionBudget { return &policyv1.PodDisruptionBudget{} }, func(pdb *policyv1.PodDisruptionBudget) (*SelectorRef, error) {
+		return labelSelectorRef("PodDisruptionBudget", pdb.Namespace, pdb.Name, pdb.Spec.Selector)
+	})
+}
+
+func indexDeployments(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "Deployment", func() *appsv1.Deployment { return &appsv1.Deployment{} }, func(obj *appsv1.Deployment) (*SelectorRef, error) {
+		return labelSelectorRef("Deployment", obj.Namespace, obj.Name, obj.Spec.Selector)
+	})
+}
+
+func indexReplicaSets(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "ReplicaSet", func() *appsv1.ReplicaSet { return &appsv1.ReplicaSet{} }, func(obj *appsv1.ReplicaSet) (*SelectorRef, error) {
+		return labelSelectorRef("ReplicaSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+	})
+}
+
+func indexStatefulSets(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "StatefulSet", func() *appsv1.StatefulSet { return &appsv1.StatefulSet{} }, func(obj *appsv1.StatefulSet) (*SelectorRef, error) {
+		return labelSelectorRef("StatefulSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+	})
+}
+
+func indexDaemonSets(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "DaemonSet", func() *appsv1.DaemonSet { return &appsv1.DaemonSet{} }, func(obj *appsv1.DaemonSet) (*SelectorRef, error) {
+		return labelSelectorRef("DaemonSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+	})
+}
+
+func indexJobs(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return indexSingleSource(mgr, idx, "Job", func() *batchv1.Job { return &batchv1.Job{} }, func(obj *batchv1.Job) (*SelectorRef, error) {
+		if obj.Spec.Selector == nil {
+			return nil, nil
+		}
+		return labelSelectorRef("Job", obj.Namespace, obj.Name, obj.Spec.Selector)
+	})
+}
+
+// indexHorizontalPodAutoscalers is registered directly rather than through
+// indexSingleSource because resolving an HPA's selector means fetching its
+// scaleTargetRef, which needs the live ctx/client a reconcile has and a
+// bare toRef conversion does not.
+func indexHorizontalPodAutoscalers(mgr ctrl.Manager, idx *SelectorIndex) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&autoscalingv2.HorizontalPodAutoscaler{}).
+		Complete(reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			key := objectKey("HorizontalPodAutoscaler", req.Namespace, req.Name)
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+			if err := mgr.GetClient().Get(ctx, req.NamespacedName, hpa); err != nil {
+				if errors.IsNotFound(err) {
+					idx.remove(key)
+					return reconcile.Result{}, nil
+				}
+				return reconcile.Result{}, err
+			}
+			selector, err := scaleTargetSelector(ctx, mgr.GetClient(), hpa.Namespace, hpa.Spec.ScaleTargetRef)
+			if err != nil {
+				podlog.Error(err, "could not resolve HorizontalPodAutoscaler scaleTargetRef", "horizontalPodAutoscaler", hpa.Name, "namespace", hpa.Namespace)
+				idx.remove(key)
+				return reconcile.Result{}, nil
+			}
+			if selector == nil {
+				idx.remove(key)
+				return reconcile.Result{}, nil
+			}
+			ref := SelectorRef{Kind: "HorizontalPodAutoscaler", Namespace: hpa.Namespace, Name: hpa.Name, Selector: selector}
+			entries, keyed := selectorSourceEntry(ref)
+			idx.update(key, entries, keyed)
+			return reconcile.Result{}, nil
+		}))
+}
+
+// selectorKeysFromLabelSelector converts sel and returns the label keys its
+// requirements reference, or nil if sel is nil or invalid.
+func selectorKeysFromLabelSelector(sel *metav1.LabelSelector) []string {
+	if sel == nil {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return nil
+	}
+	return selectorKeys(selector)
+}
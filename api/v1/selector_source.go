@@ -0,0 +1,350 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SelectorRef names a single object together with the label selector it
+// uses to pick pods, so a warning can say exactly which object is affected
+// (e.g. "Service default/frontend selector no longer matches").
+type SelectorRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Selector  labels.Selector
+}
+
+// SelectorSource lists every object of a given kind in a namespace together
+// with the selector it uses to pick pods. Implementations guard resource
+// kinds beyond NetworkPolicy (Service, PodDisruptionBudget, the various
+// workload controllers, HorizontalPodAutoscaler, ...), and new kinds are
+// added by registering another SelectorSource rather than editing
+// PodValidator.Handle.
+type SelectorSource interface {
+	// Name identifies this source for PodLabelGuardPolicy's
+	// disabledSources opt-out list, e.g. "Service".
+	Name() string
+	// List returns the (object, selector) pairs visible in namespace.
+	// Objects with no pod-selecting selector (e.g. an externalName
+	// Service) are omitted rather than returned with an empty selector,
+	// since an empty selector would otherwise be read as "matches every
+	// pod".
+	List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error)
+}
+
+// defaultSelectorSources returns the built-in SelectorSources PodValidator
+// evaluates unless a PodLabelGuardPolicy opts a namespace out of one.
+func defaultSelectorSources() []SelectorSource {
+	return []SelectorSource{
+		serviceSelectorSource{},
+		podDisruptionBudgetSelectorSource{},
+		deploymentSelectorSource{},
+		replicaSetSelectorSource{},
+		statefulSetSelectorSource{},
+		daemonSetSelectorSource{},
+		jobSelectorSource{},
+		horizontalPodAutoscalerSelectorSource{},
+	}
+}
+
+type serviceSelectorSource struct{}
+
+func (serviceSelectorSource) Name() string { return "Service" }
+
+func (serviceSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &corev1.ServiceList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, svc := range list.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		refs = append(refs, SelectorRef{
+			Kind:      "Service",
+			Namespace: svc.Namespace,
+			Name:      svc.Name,
+			Selector:  labels.SelectorFromSet(svc.Spec.Selector),
+		})
+	}
+	return refs, nil
+}
+
+type podDisruptionBudgetSelectorSource struct{}
+
+func (podDisruptionBudgetSelectorSource) Name() string { return "PodDisruptionBudget" }
+
+func (podDisruptionBudgetSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &policyv1.PodDisruptionBudgetList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, pdb := range list.Items {
+		selector, err := labelSelectorRef("PodDisruptionBudget", pdb.Namespace, pdb.Name, pdb.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on PodDisruptionBudget", "podDisruptionBudget", pdb.Name, "namespace", pdb.Namespace)
+			continue
+		}
+		if selector != nil {
+			refs = append(refs, *selector)
+		}
+	}
+	return refs, nil
+}
+
+type deploymentSelectorSource struct{}
+
+func (deploymentSelectorSource) Name() string { return "Deployment" }
+
+func (deploymentSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &appsv1.DeploymentList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, obj := range list.Items {
+		ref, err := labelSelectorRef("Deployment", obj.Namespace, obj.Name, obj.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on Deployment", "deployment", obj.Name, "namespace", obj.Namespace)
+			continue
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+type replicaSetSelectorSource struct{}
+
+func (replicaSetSelectorSource) Name() string { return "ReplicaSet" }
+
+func (replicaSetSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &appsv1.ReplicaSetList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, obj := range list.Items {
+		ref, err := labelSelectorRef("ReplicaSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on ReplicaSet", "replicaSet", obj.Name, "namespace", obj.Namespace)
+			continue
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+type statefulSetSelectorSource struct{}
+
+func (statefulSetSelectorSource) Name() string { return "StatefulSet" }
+
+func (statefulSetSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &appsv1.StatefulSetList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, obj := range list.Items {
+		ref, err := labelSelectorRef("StatefulSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on StatefulSet", "statefulSet", obj.Name, "namespace", obj.Namespace)
+			continue
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+type daemonSetSelectorSource struct{}
+
+func (daemonSetSelectorSource) Name() string { return "DaemonSet" }
+
+func (daemonSetSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &appsv1.DaemonSetList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, obj := range list.Items {
+		ref, err := labelSelectorRef("DaemonSet", obj.Namespace, obj.Name, obj.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on DaemonSet", "daemonSet", obj.Name, "namespace", obj.Namespace)
+			continue
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+type jobSelectorSource struct{}
+
+func (jobSelectorSource) Name() string { return "Job" }
+
+func (jobSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &batchv1.JobList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, obj := range list.Items {
+		// Job.Spec.Selector is usually nil (defaulted by the controller
+		// from the pod template's labels); skip rather than guess.
+		if obj.Spec.Selector == nil {
+			continue
+		}
+		ref, err := labelSelectorRef("Job", obj.Namespace, obj.Name, obj.Spec.Selector)
+		if err != nil {
+			podlog.Error(err, "invalid selector on Job", "job", obj.Name, "namespace", obj.Namespace)
+			continue
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+// horizontalPodAutoscalerSelectorSource resolves each HPA's
+// Spec.ScaleTargetRef to the selector of the workload it scales, so a label
+// change that would desync a pod from its HPA's target is caught the same
+// way as any other selector mismatch.
+type horizontalPodAutoscalerSelectorSource struct{}
+
+func (horizontalPodAutoscalerSelectorSource) Name() string { return "HorizontalPodAutoscaler" }
+
+func (horizontalPodAutoscalerSelectorSource) List(ctx context.Context, c client.Client, namespace string) ([]SelectorRef, error) {
+	list := &autoscalingv2.HorizontalPodAutoscalerList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var refs []SelectorRef
+	for _, hpa := range list.Items {
+		targetSelector, err := scaleTargetSelector(ctx, c, namespace, hpa.Spec.ScaleTargetRef)
+		if err != nil {
+			podlog.Error(err, "could not resolve HorizontalPodAutoscaler scaleTargetRef", "horizontalPodAutoscaler", hpa.Name, "namespace", namespace)
+			continue
+		}
+		if targetSelector == nil {
+			// Target workload not found, or of a kind scaleTargetSelector
+			// does not resolve; avoid blocking admission on a reference
+			// that may simply not exist yet.
+			continue
+		}
+		refs = append(refs, SelectorRef{
+			Kind:      "HorizontalPodAutoscaler",
+			Namespace: namespace,
+			Name:      hpa.Name,
+			Selector:  targetSelector,
+		})
+	}
+	return refs, nil
+}
+
+// scaleTargetSelector fetches the workload named by ref and returns the
+// label selector it uses to pick pods, or nil if the kind is unsupported or
+// the object does not exist.
+func scaleTargetSelector(ctx context.Context, c client.Client, namespace string, ref autoscalingv2.CrossVersionObjectReference) (labels.Selector, error) {
+	key := client.ObjectKey{Namespace: namespace, Name: ref.Name}
+	switch ref.Kind {
+	case "Deployment":
+		obj := &appsv1.Deployment{}
+		if err := c.Get(ctx, key, obj); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return metav1.LabelSelectorAsSelector(obj.Spec.Selector)
+	case "StatefulSet":
+		obj := &appsv1.StatefulSet{}
+		if err := c.Get(ctx, key, obj); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return metav1.LabelSelectorAsSelector(obj.Spec.Selector)
+	case "ReplicaSet":
+		obj := &appsv1.ReplicaSet{}
+		if err := c.Get(ctx, key, obj); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return metav1.LabelSelectorAsSelector(obj.Spec.Selector)
+	default:
+		return nil, nil
+	}
+}
+
+// labelSelectorRef converts a *metav1.LabelSelector into a SelectorRef,
+// returning (nil, nil) when sel is nil so callers can skip objects that
+// have no selector yet rather than treating it as "matches everything".
+func labelSelectorRef(kind, namespace, name string, sel *metav1.LabelSelector) (*SelectorRef, error) {
+	if sel == nil {
+		return nil, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+	return &SelectorRef{Kind: kind, Namespace: namespace, Name: name, Selector: selector}, nil
+}
+
+// selectorSourceWarnings runs every enabled SelectorSource against namespace
+// and reports every object whose match status flips between oldLabels and
+// newLabels.
+func selectorSourceWarnings(ctx context.Context, c client.Client, sources []SelectorSource, disabled map[string]struct{}, namespace string, oldLabels, newLabels labels.Set) []string {
+	var warnings []string
+	for _, source := range sources {
+		if _, skip := disabled[source.Name()]; skip {
+			continue
+		}
+		refs, err := source.List(ctx, c, namespace)
+		if err != nil {
+			podlog.Error(err, "error listing selector source", "source", source.Name(), "namespace", namespace)
+			continue
+		}
+		for _, ref := range refs {
+			oldMatch := ref.Selector.Matches(oldLabels)
+			newMatch := ref.Selector.Matches(newLabels)
+			if oldMatch == newMatch {
+				continue
+			}
+			if oldMatch && !newMatch {
+				warnings = append(warnings, fmt.Sprintf("%s %s/%s selector no longer matches", ref.Kind, ref.Namespace, ref.Name))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s %s/%s selector newly matches", ref.Kind, ref.Namespace, ref.Name))
+			}
+		}
+	}
+	return warnings
+}
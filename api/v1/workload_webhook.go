@@ -0,0 +1,140 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// WorkloadValidator intercepts UPDATE requests for the workload kinds that
+// recreate pods from a template (Deployment, StatefulSet, DaemonSet,
+// ReplicaSet, Job) and runs the same guard pipeline PodValidator runs on a
+// live pod, but projected from spec.template.metadata.labels: users rarely
+// `kubectl edit pod`, they edit the owning workload, which recreates pods
+// with the new labels and can silently break a NetworkPolicy or Service
+// selector well before any pod admission request ever sees it.
+type WorkloadValidator struct {
+	labelGuard
+	decoder admission.Decoder
+}
+
+func NewWorkloadValidator(c client.Client, d admission.Decoder, r record.EventRecorder, idx *SelectorIndex) *WorkloadValidator {
+	return &WorkloadValidator{labelGuard: newLabelGuard(c, r, idx), decoder: d}
+}
+
+// Handle decodes the old and new pod template labels for req and runs them
+// through the same guard pipeline PodValidator.Handle uses, reporting the
+// NetworkPolicy/SelectorSource matches the resulting pods would gain or
+// lose. Only UPDATE is guarded: a CREATE has no prior template to diff
+// against, and the PodValidator webhook already covers label changes made
+// directly on a pod.
+func (v *WorkloadValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	defer func() { admissionLatencySeconds.Observe(time.Since(start).Seconds()) }()
+
+	if req.Operation != admissionv1.Update {
+		return admission.Allowed("WorkloadValidator only guards UPDATE")
+	}
+
+	newObj, newLabels, newContainers, err := decodeWorkloadTemplate(v.decoder, req.Kind.Kind, req.Object)
+	if err != nil {
+		fmt.Println("Error decoding workload:", err)
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	_, oldLabels, _, err := decodeWorkloadTemplate(v.decoder, req.Kind.Kind, req.OldObject)
+	if err != nil {
+		fmt.Println("Error decoding old workload:", err)
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	description := fmt.Sprintf("%s %s/%s pod template", req.Kind.Kind, req.Namespace, req.Name)
+	fmt.Printf("Received workload label validator request for %s\n\n", description)
+
+	return v.evaluate(ctx, req.Namespace, oldLabels, newLabels, containerPortNames(newContainers), newObj, description)
+}
+
+// decodeWorkloadTemplate decodes raw into the concrete type named by kind
+// and returns the object together with the labels and container ports its
+// spec.template would give the pods it creates. kind is one of the workload
+// kinds WorkloadValidator is registered for; any other value is a
+// configuration error in how the webhook was registered, not something a
+// caller can recover from per-request.
+func decodeWorkloadTemplate(d admission.Decoder, kind string, raw runtime.RawExtension) (client.Object, map[string]string, []corev1.Container, error) {
+	switch kind {
+	case "Deployment":
+		obj := &appsv1.Deployment{}
+		if err := d.DecodeRaw(raw, obj); err != nil {
+			return nil, nil, nil, err
+		}
+		return obj, obj.Spec.Template.Labels, obj.Spec.Template.Spec.Containers, nil
+	case "StatefulSet":
+		obj := &appsv1.StatefulSet{}
+		if err := d.DecodeRaw(raw, obj); err != nil {
+			return nil, nil, nil, err
+		}
+		return obj, obj.Spec.Template.Labels, obj.Spec.Template.Spec.Containers, nil
+	case "DaemonSet":
+		obj := &appsv1.DaemonSet{}
+		if err := d.DecodeRaw(raw, obj); err != nil {
+			return nil, nil, nil, err
+		}
+		return obj, obj.Spec.Template.Labels, obj.Spec.Template.Spec.Containers, nil
+	case "ReplicaSet":
+		obj := &appsv1.ReplicaSet{}
+		if err := d.DecodeRaw(raw, obj); err != nil {
+			return nil, nil, nil, err
+		}
+		return obj, obj.Spec.Template.Labels, obj.Spec.Template.Spec.Containers, nil
+	case "Job":
+		obj := &batchv1.Job{}
+		if err := d.DecodeRaw(raw, obj); err != nil {
+			return nil, nil, nil, err
+		}
+		return obj, obj.Spec.Template.Labels, obj.Spec.Template.Spec.Containers, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("WorkloadValidator does not support kind %q", kind)
+	}
+}
+
+// WorkloadValidator implements admission.DecoderInjector.
+// A decoder will be automatically injected.
+
+// InjectDecoder injects the decoder.
+func (v *WorkloadValidator) InjectDecoder(d admission.Decoder) error {
+	fmt.Println("Inject Decoder is called")
+	v.decoder = d
+	return nil
+}
+
+// func (r *WorkloadValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+// 	return ctrl.NewWebhookManagedBy(mgr).
+// 		For(r).
+// 		WithValidator(&WorkloadValidator{Client: mgr.GetClient()}).
+// 		Complete()
+// }